@@ -2,6 +2,7 @@ package shadowsocks
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 )
 
@@ -14,9 +15,26 @@ type Config struct {
 	Nonop        bool      `json:"nonop"`
 	UdpRelay     bool `json:"udprelay"`
 	UdpOverTCP bool `json:"udpovertcp"`
+	Obfs         string    `json:"obfs"`
+	ObfsCert     string    `json:"obfscert"`
+	Transport       string `json:"transport"`
+	KcpMode         string `json:"kcpmode"`
+	KcpMtu          int    `json:"kcpmtu"`
+	KcpSndwnd       int    `json:"kcpsndwnd"`
+	KcpRcvwnd       int    `json:"kcprcvwnd"`
+	KcpDataShards   int    `json:"kcpdatashards"`
+	KcpParityShards int    `json:"kcpparityshards"`
+	CoalesceMaxDelay *int  `json:"coalescemaxdelay"`
+	CoalesceMinSize  int   `json:"coalesceminsize"`
+	Plugin       string    `json:"plugin"`
+	PluginOpts   string    `json:"plugin-opts"`
+	Obfs4IatMode bool      `json:"obfs4iatmode"`
 	Backend      *Config   `json:"backend"`
 	Backends     []*Config `json:"backends"`
 	Ivlen        int
+
+	obfs4ID *obfs4Identity
+	plugin  *pluginProcess
 }
 
 func ReadConfig(path string) (configs []*Config, err error) {
@@ -33,12 +51,14 @@ func ReadConfig(path string) (configs []*Config, err error) {
 		}
 	}
 	for _, c := range configs {
-		CheckConfig(c)
+		if err = CheckConfig(c); err != nil {
+			return
+		}
 	}
 	return
 }
 
-func CheckConfig(c *Config) {
+func CheckConfig(c *Config) error {
 	if len(c.Password) == 0 {
 		c.Password = defaultPassword
 	}
@@ -48,6 +68,22 @@ func CheckConfig(c *Config) {
 	if c.Ivlen == 0 {
 		c.Ivlen = GetIvLen(c.Method)
 	}
+	if len(c.Obfs) == 0 {
+		c.Obfs = "none"
+	}
+	if c.Obfs == "obfs4" && c.Type == "server" {
+		id, err := loadOrCreateObfs4Identity(obfs4StateFile)
+		if err != nil {
+			return fmt.Errorf("obfs4: load/create identity: %v", err)
+		}
+		c.obfs4ID = id
+	}
+	if len(c.Transport) == 0 {
+		c.Transport = "tcp"
+	}
+	if len(c.KcpMode) == 0 {
+		c.KcpMode = "normal"
+	}
 	if c.Backend != nil {
 		c.Backends = append(c.Backends, c.Backend)
 	}
@@ -65,6 +101,9 @@ func CheckConfig(c *Config) {
 		c.UdpOverTCP = false
 	}
 	for _, v := range c.Backends {
-		CheckConfig(v)
+		if err := CheckConfig(v); err != nil {
+			return err
+		}
 	}
+	return nil
 }
\ No newline at end of file
@@ -0,0 +1,60 @@
+package shadowsocks
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestKCPRoundTrip(t *testing.T) {
+	c := &Config{Password: "test-password", KcpMode: "fast2"}
+
+	lis, err := ListenKCP("127.0.0.1:0", c)
+	if err != nil {
+		t.Fatalf("ListenKCP: %v", err)
+	}
+	defer lis.Close()
+
+	accepted := make(chan error, 1)
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			accepted <- err
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			accepted <- err
+			return
+		}
+		if string(buf) != "hello" {
+			accepted <- io.ErrUnexpectedEOF
+			return
+		}
+		_, err = conn.Write([]byte("world"))
+		accepted <- err
+	}()
+
+	conn, err := DialKCP(lis.Addr().String(), c)
+	if err != nil {
+		t.Fatalf("DialKCP: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	buf := make([]byte, 5)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(buf) != "world" {
+		t.Fatalf("got %q, want %q", buf, "world")
+	}
+
+	if err := <-accepted; err != nil {
+		t.Fatalf("server side: %v", err)
+	}
+}
@@ -10,79 +10,123 @@ import (
 )
 
 const (
-	delayConnTick = time.Millisecond * 10
+	// coalesceDefaultMaxDelay is used when Config.CoalesceMaxDelay is nil;
+	// an explicit 0 instead disables coalescing outright.
+	coalesceDefaultMaxDelay = time.Millisecond * 10
+	// coalesceDefaultMinSize is used when Config.CoalesceMinSize is 0.
+	coalesceDefaultMinSize = 1200
+	// coalescePushThreshold bounds how much we'll ever buffer before
+	// flushing regardless of timers, so one slow reader can't make us
+	// grow without limit.
+	coalescePushThreshold = buffersize
+	ewmaAlpha              = 0.2
 )
 
+// DelayConn coalesces small, closely-spaced writes into fewer underlying
+// Conn.Write calls (similar in spirit to TCP_CORK), which helps
+// shadowsocks' per-packet overhead on bulk transfers without hurting
+// interactive protocols like SSH: it tracks an EWMA of the interval
+// between writes and only holds data as long as the caller keeps writing
+// at roughly that cadence. A write that follows a quiet spell longer than
+// the maximum delay is sent at once; held data is flushed when no further
+// write arrives within the EWMA interval (capped at the maximum delay) or
+// when it reaches the push threshold.
 type DelayConn struct {
 	net.Conn
-	wbuf      [buffersize]byte
-	off       int
-	cond      *sync.Cond
-	die       chan bool
-	started   bool
+	mu        sync.Mutex
+	buf       []byte
+	timer     *time.Timer
+	maxDelay  time.Duration
+	minSize   int
+	lastWrite time.Time
+	ewma      time.Duration
 	destroyed bool
 }
 
+func NewDelayConn(conn net.Conn, c *Config) *DelayConn {
+	maxDelay := coalesceDefaultMaxDelay
+	if c.CoalesceMaxDelay != nil {
+		maxDelay = time.Duration(*c.CoalesceMaxDelay) * time.Millisecond
+	}
+	minSize := coalesceDefaultMinSize
+	if c.CoalesceMinSize != 0 {
+		minSize = c.CoalesceMinSize
+	}
+	return &DelayConn{
+		Conn:     conn,
+		maxDelay: maxDelay,
+		minSize:  minSize,
+	}
+}
+
 func (c *DelayConn) Close() error {
-	c.cond.L.Lock()
-	defer c.cond.L.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	if c.destroyed {
 		return nil
 	}
 	c.destroyed = true
-	close(c.die)
-	c.cond.Broadcast()
+	if c.timer != nil {
+		c.timer.Stop()
+	}
 	return c.Conn.Close()
 }
 
-func (c *DelayConn) sendLoopOnce() (ok bool) {
-	c.cond.L.Lock()
-	var err error
-	defer func() {
-		c.cond.L.Unlock()
-		if err != nil {
-			c.Close()
-		}
-	}()
-	if c.destroyed {
-		return
+func (c *DelayConn) stopTimerLocked() {
+	if c.timer != nil {
+		c.timer.Stop()
 	}
-	if c.off == 0 {
-		c.cond.Wait()
-	}
-	if c.destroyed {
+}
+
+func (c *DelayConn) resetTimerLocked(d time.Duration) {
+	if c.timer == nil {
+		c.timer = time.AfterFunc(d, c.flush)
 		return
 	}
-	if c.off == 0 {
-		return true
-	}
-	c.cond.L.Unlock()
-	select {
-	case <-c.die:
-		c.cond.L.Lock()
+	c.timer.Reset(d)
+}
+
+func (c *DelayConn) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.destroyed || len(c.buf) == 0 {
 		return
-	case <-time.After(delayConnTick):
 	}
-	c.cond.L.Lock()
-	if c.off == 0 {
-		return true
+	_, err := c.Conn.Write(c.buf)
+	c.buf = nil
+	if err != nil {
+		c.destroyed = true
 	}
-	_, err = c.Conn.Write(c.wbuf[:c.off])
-	c.off = 0
-	return err == nil
 }
 
-func (c *DelayConn) sendLoop() {
-	for {
-		if !c.sendLoopOnce() {
-			break
+// PushWrite writes b immediately, flushing any already-coalesced data
+// first, bypassing the delay timer entirely. Use it for latency-sensitive
+// frames that shouldn't wait on the coalescing window. Per the io.Writer
+// contract, n only ever counts bytes attributable to b itself, even though
+// the underlying write may also flush previously buffered bytes ahead of it.
+func (c *DelayConn) PushWrite(b []byte) (n int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	bufLen := len(c.buf)
+	combined := b
+	if bufLen != 0 {
+		combined = append(c.buf, b...)
+		c.buf = nil
+	}
+	c.stopTimerLocked()
+	wn, err := c.Conn.Write(combined)
+	if wn > bufLen {
+		n = wn - bufLen
+		if n > len(b) {
+			n = len(b)
 		}
 	}
+	return
 }
 
 func (c *DelayConn) Write(b []byte) (n int, err error) {
-	c.cond.L.Lock()
-	defer c.cond.L.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	n = len(b)
 	defer func() {
 		if err != nil {
@@ -92,34 +136,47 @@ func (c *DelayConn) Write(b []byte) (n int, err error) {
 	if n == 0 {
 		return
 	}
-	if n+c.off >= buffersize {
-		buf := make([]byte, n+c.off)
-		copy(buf, c.wbuf[:c.off])
-		copy(buf[c.off:], b)
-		_, err = c.Conn.Write(buf)
-		c.off = 0
+	if c.maxDelay == 0 || len(b) >= c.minSize || len(b)+len(c.buf) >= coalescePushThreshold {
+		if len(c.buf) != 0 {
+			b = append(c.buf, b...)
+			c.buf = nil
+		}
+		c.stopTimerLocked()
+		_, err = c.Conn.Write(b)
 		return
 	}
-	copy(c.wbuf[c.off:], b)
-	c.off += len(b)
-	if !c.started {
-		c.started = true
-		go c.sendLoop()
+	now := time.Now()
+	if !c.lastWrite.IsZero() {
+		interval := now.Sub(c.lastWrite)
+		if c.ewma == 0 {
+			c.ewma = interval
+		} else {
+			c.ewma = time.Duration(float64(c.ewma)*(1-ewmaAlpha) + float64(interval)*ewmaAlpha)
+		}
 	}
-	c.cond.Signal()
-	return
-}
-
-func NewDelayConn(conn net.Conn) *DelayConn {
-	return &DelayConn{
-		Conn: conn,
-		die:  make(chan bool),
-		cond: sync.NewCond(&sync.Mutex{}),
+	quiet := c.lastWrite.IsZero() || now.Sub(c.lastWrite) > c.maxDelay
+	c.lastWrite = now
+	if quiet {
+		// no recent write to coalesce with, so send this one at once
+		if len(c.buf) != 0 {
+			b = append(c.buf, b...)
+			c.buf = nil
+		}
+		c.stopTimerLocked()
+		_, err = c.Conn.Write(b)
+		return
 	}
+	c.buf = append(c.buf, b...)
+	wait := c.ewma
+	if wait == 0 || wait > c.maxDelay {
+		wait = c.maxDelay
+	}
+	c.resetTimerLocked(wait)
+	return
 }
 
-func delayAcceptHandler(conn net.Conn, _ *listener) net.Conn {
-	return NewDelayConn(conn)
+func delayAcceptHandler(conn net.Conn, lis *listener) net.Conn {
+	return NewDelayConn(conn, lis.c)
 }
 
 type ObfsConn struct {
@@ -398,6 +455,7 @@ func DialObfs(target string, c *Config) (conn net.Conn, err error) {
 			conn.Close()
 		}
 	}()
+	target = c.effectiveDialAddr(target)
 	conn, err = c.pool.GetNonblock()
 	if err != nil {
 		conn, err = net.Dial("tcp", target)
@@ -0,0 +1,763 @@
+package shadowsocks
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/poly1305"
+)
+
+// obfs4 implements a (simplified) obfs4 pluggable transport: an ntor
+// handshake over curve25519 with elligator2-encoded public keys, followed
+// by a framed, MAC-authenticated stream with randomized inter-arrival
+// timing. Unlike ObfsConn's HTTP masquerade, the wire format here carries
+// no recognizable header, which is the whole point.
+const (
+	obfs4NodeIDLen   = 20
+	obfs4KeyLen      = 32
+	obfs4MacLen      = 16
+	obfs4LenFieldLen = 2
+	obfs4MaxFrame    = 1448
+	obfs4MinPadLen   = 0
+	obfs4MaxPadLen   = 128
+
+	obfs4ProtoID      = "obfs4-ntor-curve25519-sha256-1"
+	obfs4StateFile    = "obfs4_state.json"
+	obfs4HandshakeMax = 8096
+)
+
+// obfs4Identity is a server's long-term node id + ntor keypair. It is
+// generated once and persisted to disk so the cert handed to clients
+// (Config.ObfsCert) stays stable across restarts.
+type obfs4Identity struct {
+	NodeID  [obfs4NodeIDLen]byte
+	Private [obfs4KeyLen]byte
+	Public  [obfs4KeyLen]byte
+}
+
+type obfs4IdentityFile struct {
+	NodeID  string `json:"node-id"`
+	Private string `json:"private-key"`
+	Public  string `json:"public-key"`
+}
+
+// Cert returns the node-id||public-key blob clients put in Config.ObfsCert.
+func (id *obfs4Identity) Cert() string {
+	buf := make([]byte, 0, obfs4NodeIDLen+obfs4KeyLen)
+	buf = append(buf, id.NodeID[:]...)
+	buf = append(buf, id.Public[:]...)
+	return base64.StdEncoding.EncodeToString(buf)
+}
+
+func parseObfs4Cert(cert string) (nodeID [obfs4NodeIDLen]byte, pub [obfs4KeyLen]byte, err error) {
+	raw, err := base64.StdEncoding.DecodeString(cert)
+	if err != nil {
+		return
+	}
+	if len(raw) != obfs4NodeIDLen+obfs4KeyLen {
+		err = fmt.Errorf("obfs4: invalid cert length %d", len(raw))
+		return
+	}
+	copy(nodeID[:], raw[:obfs4NodeIDLen])
+	copy(pub[:], raw[obfs4NodeIDLen:])
+	return
+}
+
+// loadOrCreateObfs4Identity reads path, or generates and persists a fresh
+// node id + keypair if it doesn't exist yet.
+func loadOrCreateObfs4Identity(path string) (*obfs4Identity, error) {
+	if data, err := ioutil.ReadFile(path); err == nil {
+		var f obfs4IdentityFile
+		if err := json.Unmarshal(data, &f); err == nil {
+			id := &obfs4Identity{}
+			nodeID, err1 := base64.StdEncoding.DecodeString(f.NodeID)
+			priv, err2 := base64.StdEncoding.DecodeString(f.Private)
+			pub, err3 := base64.StdEncoding.DecodeString(f.Public)
+			if err1 == nil && err2 == nil && err3 == nil &&
+				len(nodeID) == obfs4NodeIDLen && len(priv) == obfs4KeyLen && len(pub) == obfs4KeyLen {
+				copy(id.NodeID[:], nodeID)
+				copy(id.Private[:], priv)
+				copy(id.Public[:], pub)
+				return id, nil
+			}
+		}
+	}
+	id := &obfs4Identity{}
+	if _, err := rand.Read(id.NodeID[:]); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(id.Private[:]); err != nil {
+		return nil, err
+	}
+	id.Private[0] &= 248
+	id.Private[31] &= 127
+	id.Private[31] |= 64
+	curve25519.ScalarBaseMult(&id.Public, &id.Private)
+	f := obfs4IdentityFile{
+		NodeID:  base64.StdEncoding.EncodeToString(id.NodeID[:]),
+		Private: base64.StdEncoding.EncodeToString(id.Private[:]),
+		Public:  base64.StdEncoding.EncodeToString(id.Public[:]),
+	}
+	if data, err := json.MarshalIndent(&f, "", "  "); err == nil {
+		ioutil.WriteFile(path, data, 0600)
+	}
+	return id, nil
+}
+
+// --- elligator2 -------------------------------------------------------
+
+var obfs4FieldP, _ = new(big.Int).SetString(
+	"57896044618658097711785492504343953926634992332820282019728792003956564819949", 10)
+
+const obfs4CurveA = 486662
+
+// elligator2Encode maps an X25519 public key onto a uniformly random
+// looking 32 byte string, so the handshake doesn't contain a recognizable
+// curve point on the wire. It is the exact algebraic inverse of
+// elligator2Decode's u = -A/(1+2r^2): solving that for r given u yields
+// r^2 = -(u+A)/(2u). Only about half of all points have a representative
+// (the caller retries with a fresh ephemeral key when ok is false).
+func elligator2Encode(pub *[obfs4KeyLen]byte) (rep [obfs4KeyLen]byte, ok bool) {
+	u := leToInt(pub[:])
+	p := obfs4FieldP
+	a := big.NewInt(obfs4CurveA)
+
+	denom := new(big.Int).Lsh(u, 1)
+	denom.Mod(denom, p)
+	if denom.Sign() == 0 {
+		return rep, false
+	}
+	inv := new(big.Int).ModInverse(denom, p)
+	if inv == nil {
+		return rep, false
+	}
+	uPlusA := new(big.Int).Add(u, a)
+	uPlusA.Mod(uPlusA, p)
+	r2 := new(big.Int).Neg(uPlusA)
+	r2.Mul(r2, inv)
+	r2.Mod(r2, p)
+	r := sqrtModP(r2, p)
+	if r == nil {
+		return rep, false
+	}
+	// r and p-r are both valid roots; elligator2Decode only ever sees
+	// the low 254 bits (rep[31] &= 0x3f), so we must pick the root that
+	// actually fits in that range before truncating, or we silently
+	// encode the wrong one half the time.
+	twoPow254 := new(big.Int).Lsh(big.NewInt(1), 254)
+	if r.Cmp(twoPow254) >= 0 {
+		r.Sub(p, r)
+	}
+	intToLE(r, rep[:])
+	rep[31] &= 0x3f
+	return rep, true
+}
+
+// elligator2Decode is the inverse map used by the peer that received a
+// representative over the wire.
+func elligator2Decode(rep *[obfs4KeyLen]byte) [obfs4KeyLen]byte {
+	p := obfs4FieldP
+	a := big.NewInt(obfs4CurveA)
+	buf := make([]byte, obfs4KeyLen)
+	copy(buf, rep[:])
+	buf[31] &= 0x3f
+	r := leToInt(buf)
+	r2 := new(big.Int).Mul(r, r)
+	r2.Mod(r2, p)
+
+	// u = -A / (1 + 2r^2)
+	denom := new(big.Int).Lsh(r2, 1)
+	denom.Add(denom, big.NewInt(1))
+	denom.Mod(denom, p)
+	inv := new(big.Int).ModInverse(denom, p)
+	var u *big.Int
+	if inv == nil {
+		u = big.NewInt(0)
+	} else {
+		u = new(big.Int).Neg(a)
+		u.Mul(u, inv)
+		u.Mod(u, p)
+	}
+	var out [obfs4KeyLen]byte
+	intToLE(u, out[:])
+	return out
+}
+
+func leToInt(b []byte) *big.Int {
+	be := make([]byte, len(b))
+	for i, v := range b {
+		be[len(b)-1-i] = v
+	}
+	return new(big.Int).SetBytes(be)
+}
+
+func intToLE(v *big.Int, out []byte) {
+	for i := range out {
+		out[i] = 0
+	}
+	be := v.Bytes()
+	for i := 0; i < len(be) && i < len(out); i++ {
+		out[i] = be[len(be)-1-i]
+	}
+}
+
+// sqrtModP returns a square root of a mod p for p = 2^255-19, or nil if a
+// is not a square. p % 4 == 1, so the single-exponentiation shortcut for
+// p % 4 == 3 doesn't apply; p = 8k+5 instead allows a closed form:
+// x = a^((p+3)/8), multiplied by sqrt(-1) = 2^((p-1)/4) when x^2 != a.
+func sqrtModP(a, p *big.Int) *big.Int {
+	if a.Sign() == 0 {
+		return big.NewInt(0)
+	}
+	// exponent (p+3)/8
+	e := new(big.Int).Add(p, big.NewInt(3))
+	e.Rsh(e, 3)
+	x := new(big.Int).Exp(a, e, p)
+	xx := new(big.Int).Mul(x, x)
+	xx.Mod(xx, p)
+	if xx.Cmp(new(big.Int).Mod(a, p)) == 0 {
+		return x
+	}
+	// try x * sqrt(-1)
+	two := big.NewInt(2)
+	sqrtMinus1Exp := new(big.Int).Sub(p, big.NewInt(1))
+	sqrtMinus1Exp.Rsh(sqrtMinus1Exp, 2)
+	i := new(big.Int).Exp(two, sqrtMinus1Exp, p)
+	x2 := new(big.Int).Mul(x, i)
+	x2.Mod(x2, p)
+	xx2 := new(big.Int).Mul(x2, x2)
+	xx2.Mod(xx2, p)
+	if xx2.Cmp(new(big.Int).Mod(a, p)) == 0 {
+		return x2
+	}
+	return nil
+}
+
+// --- ntor handshake -----------------------------------------------------
+
+func hmacSha256(key, data []byte) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write(data)
+	return m.Sum(nil)
+}
+
+// ntorKDF derives n bytes of key material from the ntor secret_input via
+// HMAC-SHA256 counter mode (the same shape as the HKDF-Expand step ntor
+// specifies, just inlined so obfs4.go doesn't pull in another package).
+func ntorKDF(secretInput []byte, label string, n int) []byte {
+	out := make([]byte, 0, n)
+	var ctr byte = 1
+	prev := []byte{}
+	for len(out) < n {
+		h := hmac.New(sha256.New, secretInput)
+		h.Write(prev)
+		h.Write([]byte(label))
+		h.Write([]byte{ctr})
+		prev = h.Sum(nil)
+		out = append(out, prev...)
+		ctr++
+	}
+	return out[:n]
+}
+
+type obfs4SessionKeys struct {
+	clientToServer [obfs4KeyLen]byte
+	serverToClient [obfs4KeyLen]byte
+}
+
+// ntorClientHandshake performs the client side of the ntor key exchange
+// against a server identified by nodeID/serverPub, using conn for the
+// handshake bytes. It returns the derived per-direction session keys.
+func ntorClientHandshake(conn net.Conn, nodeID [obfs4NodeIDLen]byte, serverPub [obfs4KeyLen]byte) (*obfs4SessionKeys, error) {
+	var x, xpub [obfs4KeyLen]byte
+	var rep [obfs4KeyLen]byte
+	var ok bool
+	for i := 0; i < 64; i++ {
+		if _, err := rand.Read(x[:]); err != nil {
+			return nil, err
+		}
+		x[0] &= 248
+		x[31] &= 127
+		x[31] |= 64
+		curve25519.ScalarBaseMult(&xpub, &x)
+		rep, ok = elligator2Encode(&xpub)
+		if ok {
+			break
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("obfs4: failed to find elligator2 representative")
+	}
+
+	padLen, err := randRange(obfs4MinPadLen, obfs4MaxPadLen)
+	if err != nil {
+		return nil, err
+	}
+	pad := make([]byte, padLen)
+	rand.Read(pad)
+
+	mark := hmacSha256(serverPub[:], rep[:])[:16]
+	msg := append([]byte{}, rep[:]...)
+	msg = append(msg, pad...)
+	msg = append(msg, mark...)
+	macInput := append([]byte{}, msg...)
+	mac := hmacSha256(serverPub[:], macInput)[:16]
+	msg = append(msg, mac...)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	resp := make([]byte, obfs4KeyLen+32)
+	if _, err := readFull(conn, resp); err != nil {
+		return nil, err
+	}
+	var yrep [obfs4KeyLen]byte
+	copy(yrep[:], resp[:obfs4KeyLen])
+	auth := resp[obfs4KeyLen : obfs4KeyLen+32]
+	Y := elligator2Decode(&yrep)
+
+	var sharedXY, sharedXB [obfs4KeyLen]byte
+	curve25519.ScalarMult(&sharedXY, &x, &Y)
+	curve25519.ScalarMult(&sharedXB, &x, &serverPub)
+
+	secretInput := buildNtorSecretInput(sharedXY[:], sharedXB[:], nodeID, serverPub, xpub, Y)
+	verify := ntorKDF(secretInput, "obfs4-ntor-verify", 32)
+	authInput := buildNtorAuthInput(verify, nodeID, serverPub, Y, xpub)
+	expectAuth := ntorKDF(authInput, "obfs4-ntor-mac", 32)
+	if subtle.ConstantTimeCompare(expectAuth, auth) != 1 {
+		return nil, fmt.Errorf("obfs4: handshake authentication failed")
+	}
+	return deriveSessionKeys(secretInput), nil
+}
+
+// ntorServerHandshake performs the server side, reading the client's
+// handshake off conn and writing back the server's half.
+func ntorServerHandshake(conn net.Conn, id *obfs4Identity) (*obfs4SessionKeys, error) {
+	var rep [obfs4KeyLen]byte
+	if _, err := readFull(conn, rep[:]); err != nil {
+		return nil, err
+	}
+	mark := hmacSha256(id.Public[:], rep[:])[:16]
+
+	// The client appended variable-length padding before its own mark;
+	// scan for it the way the reference implementation does, bounded by
+	// obfs4HandshakeMax so a bad client can't make us buffer forever.
+	buf := append([]byte{}, rep[:]...)
+	idx := -1
+	one := make([]byte, 1)
+	for len(buf) < obfs4HandshakeMax {
+		if len(buf) >= len(rep)+16 {
+			tail := buf[len(buf)-16:]
+			if subtle.ConstantTimeCompare(tail, mark) == 1 {
+				idx = len(buf) - 16
+				break
+			}
+		}
+		if _, err := readFull(conn, one); err != nil {
+			return nil, err
+		}
+		buf = append(buf, one[0])
+	}
+	if idx < 0 {
+		return nil, fmt.Errorf("obfs4: could not locate handshake mark")
+	}
+	mac := make([]byte, 16)
+	if _, err := readFull(conn, mac); err != nil {
+		return nil, err
+	}
+	expectMac := hmacSha256(id.Public[:], buf[:idx+16])[:16]
+	if subtle.ConstantTimeCompare(expectMac, mac) != 1 {
+		return nil, fmt.Errorf("obfs4: handshake mac mismatch")
+	}
+	copy(rep[:], buf[:obfs4KeyLen])
+	X := elligator2Decode(&rep)
+
+	var y, ypub [obfs4KeyLen]byte
+	var yrep [obfs4KeyLen]byte
+	var ok bool
+	for i := 0; i < 64; i++ {
+		if _, err := rand.Read(y[:]); err != nil {
+			return nil, err
+		}
+		y[0] &= 248
+		y[31] &= 127
+		y[31] |= 64
+		curve25519.ScalarBaseMult(&ypub, &y)
+		yrep, ok = elligator2Encode(&ypub)
+		if ok {
+			break
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("obfs4: failed to find elligator2 representative")
+	}
+
+	var sharedXY, sharedBX [obfs4KeyLen]byte
+	curve25519.ScalarMult(&sharedXY, &y, &X)
+	curve25519.ScalarMult(&sharedBX, &id.Private, &X)
+
+	secretInput := buildNtorSecretInput(sharedXY[:], sharedBX[:], id.NodeID, id.Public, X, ypub)
+	verify := ntorKDF(secretInput, "obfs4-ntor-verify", 32)
+	authInput := buildNtorAuthInput(verify, id.NodeID, id.Public, ypub, X)
+	auth := ntorKDF(authInput, "obfs4-ntor-mac", 32)
+
+	resp := append([]byte{}, yrep[:]...)
+	resp = append(resp, auth...)
+	if _, err := conn.Write(resp); err != nil {
+		return nil, err
+	}
+	keys := deriveSessionKeys(secretInput)
+	return keys, nil
+}
+
+func buildNtorSecretInput(xy, xb []byte, nodeID [obfs4NodeIDLen]byte, b, x, y [obfs4KeyLen]byte) []byte {
+	buf := make([]byte, 0, 64+obfs4NodeIDLen+96+len(obfs4ProtoID))
+	buf = append(buf, xy...)
+	buf = append(buf, xb...)
+	buf = append(buf, nodeID[:]...)
+	buf = append(buf, b[:]...)
+	buf = append(buf, x[:]...)
+	buf = append(buf, y[:]...)
+	buf = append(buf, []byte(obfs4ProtoID)...)
+	return buf
+}
+
+func buildNtorAuthInput(verify []byte, nodeID [obfs4NodeIDLen]byte, b, y, x [obfs4KeyLen]byte) []byte {
+	buf := make([]byte, 0, len(verify)+obfs4NodeIDLen+96+len(obfs4ProtoID)+6)
+	buf = append(buf, verify...)
+	buf = append(buf, nodeID[:]...)
+	buf = append(buf, b[:]...)
+	buf = append(buf, y[:]...)
+	buf = append(buf, x[:]...)
+	buf = append(buf, []byte(obfs4ProtoID)...)
+	buf = append(buf, []byte("Server")...)
+	return buf
+}
+
+func deriveSessionKeys(secretInput []byte) *obfs4SessionKeys {
+	keys := &obfs4SessionKeys{}
+	material := ntorKDF(secretInput, "obfs4-ntor-key-seed", 64)
+	copy(keys.clientToServer[:], material[:obfs4KeyLen])
+	copy(keys.serverToClient[:], material[obfs4KeyLen:])
+	return keys
+}
+
+func randRange(min, max int) (int, error) {
+	if max <= min {
+		return min, nil
+	}
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	return min + int(binary.BigEndian.Uint32(b[:])%uint32(max-min)), nil
+}
+
+func readFull(conn net.Conn, buf []byte) (int, error) {
+	total := 0
+	for total < len(buf) {
+		n, err := conn.Read(buf[total:])
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// --- framing --------------------------------------------------------
+
+// frameKeystream derives a per-frame keystream of length n from a
+// session key and a monotonically increasing frame counter.
+func frameKeystream(key [obfs4KeyLen]byte, counter uint64, n int) []byte {
+	out := make([]byte, 0, n)
+	var ctrBuf [8]byte
+	binary.BigEndian.PutUint64(ctrBuf[:], counter)
+	var block byte
+	for len(out) < n {
+		h := hmacSha256(key[:], append(ctrBuf[:], block))
+		out = append(out, h...)
+		block++
+	}
+	return out[:n]
+}
+
+func framePolyKey(key [obfs4KeyLen]byte, counter uint64) (polyKey [32]byte) {
+	var ctrBuf [8]byte
+	binary.BigEndian.PutUint64(ctrBuf[:], counter)
+	copy(polyKey[:], hmacSha256(key[:], append(ctrBuf[:], "mac"...)))
+	return
+}
+
+// Obfs4Conn wraps a handshaken connection and speaks obfs4's framed,
+// length-obfuscated, MAC-authenticated protocol. Reads transparently
+// strip padding frames so the shadowsocks stream cipher above never
+// sees them.
+type Obfs4Conn struct {
+	RemainConn
+	keys     *obfs4SessionKeys
+	isClient bool
+	encCtr   uint64
+	decCtr   uint64
+	pending  []byte // decoded payload not yet delivered to Read
+
+	// iatMode, when set, sends each frame from a dedicated goroutine after
+	// a randomized delay instead of sleeping on the caller's Write path, so
+	// IAT randomization perturbs wire timing without capping throughput to
+	// one frame per sleep.
+	iatMode   bool
+	frameCh   chan []byte
+	closeCh   chan struct{}
+	closeOnce sync.Once
+
+	writeErrMu sync.Mutex
+	writeErr   error
+}
+
+func NewObfs4Conn(conn net.Conn, keys *obfs4SessionKeys, isClient, iatMode bool) *Obfs4Conn {
+	c := &Obfs4Conn{
+		RemainConn: RemainConn{Conn: conn},
+		keys:       keys,
+		isClient:   isClient,
+		iatMode:    iatMode,
+	}
+	if iatMode {
+		c.frameCh = make(chan []byte, 32)
+		c.closeCh = make(chan struct{})
+		go c.iatSender()
+	}
+	return c
+}
+
+// iatSender delivers frames queued by writeFrame, one at a time, each
+// after its own randomized delay - off the caller's Write path so IAT
+// jitter perturbs timing without blocking the writer.
+func (c *Obfs4Conn) iatSender() {
+	for {
+		select {
+		case frame := <-c.frameCh:
+			time.Sleep(time.Duration(mustRandRange(0, 2000)) * time.Microsecond)
+			if _, err := c.RemainConn.Write(frame); err != nil {
+				c.setWriteErr(err)
+			}
+		case <-c.closeCh:
+			return
+		}
+	}
+}
+
+func (c *Obfs4Conn) setWriteErr(err error) {
+	c.writeErrMu.Lock()
+	if c.writeErr == nil {
+		c.writeErr = err
+	}
+	c.writeErrMu.Unlock()
+}
+
+func (c *Obfs4Conn) getWriteErr() error {
+	c.writeErrMu.Lock()
+	defer c.writeErrMu.Unlock()
+	return c.writeErr
+}
+
+// Close stops the iatMode sender goroutine, if one is running, before
+// closing the underlying connection.
+func (c *Obfs4Conn) Close() error {
+	if c.iatMode {
+		c.closeOnce.Do(func() { close(c.closeCh) })
+	}
+	return c.RemainConn.Close()
+}
+
+func (c *Obfs4Conn) writeKey() [obfs4KeyLen]byte {
+	if c.isClient {
+		return c.keys.clientToServer
+	}
+	return c.keys.serverToClient
+}
+
+func (c *Obfs4Conn) readKey() [obfs4KeyLen]byte {
+	if c.isClient {
+		return c.keys.serverToClient
+	}
+	return c.keys.clientToServer
+}
+
+// writeFrame encrypts+authenticates a single chunk (len(payload) <=
+// obfs4MaxFrame) and writes it as one obfs4 frame.
+func (c *Obfs4Conn) writeFrame(payload []byte) error {
+	key := c.writeKey()
+	ks := frameKeystream(key, c.encCtr, len(payload))
+	ct := make([]byte, len(payload))
+	for i := range payload {
+		ct[i] = payload[i] ^ ks[i]
+	}
+	polyKey := framePolyKey(key, c.encCtr)
+	var tag [16]byte
+	poly1305.Sum(&tag, ct, &polyKey)
+
+	length := uint16(len(ct) + obfs4MacLen)
+	lenKs := frameKeystream(key, c.encCtr^0xffffffffffffffff, 2)
+	var lenBuf [2]byte
+	binary.BigEndian.PutUint16(lenBuf[:], length)
+	lenBuf[0] ^= lenKs[0]
+	lenBuf[1] ^= lenKs[1]
+
+	frame := make([]byte, 0, 2+len(ct)+16)
+	frame = append(frame, lenBuf[:]...)
+	frame = append(frame, ct...)
+	frame = append(frame, tag[:]...)
+	c.encCtr++
+
+	if c.iatMode {
+		if err := c.getWriteErr(); err != nil {
+			return err
+		}
+		select {
+		case c.frameCh <- frame:
+			return nil
+		case <-c.closeCh:
+			return fmt.Errorf("obfs4: connection closed")
+		}
+	}
+	_, err := c.RemainConn.Write(frame)
+	return err
+}
+
+func mustRandRange(min, max int) int {
+	n, err := randRange(min, max)
+	if err != nil {
+		return min
+	}
+	return n
+}
+
+// writePaddingFrame sends a zero-length payload frame purely to perturb
+// packet sizes/timing; readFrame recognizes and discards it.
+func (c *Obfs4Conn) writePaddingFrame() error {
+	return c.writeFrame(nil)
+}
+
+func (c *Obfs4Conn) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > obfs4MaxFrame {
+			chunk = b[:obfs4MaxFrame]
+		}
+		if err = c.writeFrame(chunk); err != nil {
+			return
+		}
+		n += len(chunk)
+		b = b[len(chunk):]
+		if pad, _ := randRange(0, 4); pad == 0 && len(b) > 0 {
+			c.writePaddingFrame()
+		}
+	}
+	return
+}
+
+// readFrame reads and decrypts exactly one frame off the wire.
+func (c *Obfs4Conn) readFrame() ([]byte, error) {
+	key := c.readKey()
+	var lenBuf [2]byte
+	if _, err := readFull(&c.RemainConn, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	lenKs := frameKeystream(key, c.decCtr^0xffffffffffffffff, 2)
+	lenBuf[0] ^= lenKs[0]
+	lenBuf[1] ^= lenKs[1]
+	length := binary.BigEndian.Uint16(lenBuf[:])
+	if int(length) < obfs4MacLen || int(length) > obfs4MaxFrame+obfs4MacLen {
+		return nil, fmt.Errorf("obfs4: invalid frame length %d", length)
+	}
+	body := make([]byte, length)
+	if _, err := readFull(&c.RemainConn, body); err != nil {
+		return nil, err
+	}
+	ct := body[:len(body)-obfs4MacLen]
+	tag := body[len(body)-obfs4MacLen:]
+	polyKey := framePolyKey(key, c.decCtr)
+	var gotTag [16]byte
+	copy(gotTag[:], tag)
+	if !poly1305.Verify(&gotTag, ct, &polyKey) {
+		return nil, fmt.Errorf("obfs4: frame authentication failed")
+	}
+	ks := frameKeystream(key, c.decCtr, len(ct))
+	pt := make([]byte, len(ct))
+	for i := range ct {
+		pt[i] = ct[i] ^ ks[i]
+	}
+	c.decCtr++
+	return pt, nil
+}
+
+func (c *Obfs4Conn) Read(b []byte) (n int, err error) {
+	for len(c.pending) == 0 {
+		var pt []byte
+		pt, err = c.readFrame()
+		if err != nil {
+			return
+		}
+		if len(pt) == 0 {
+			continue // padding frame, keep reading
+		}
+		c.pending = pt
+	}
+	n = copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return
+}
+
+// DialObfs4 dials target, performs the obfs4 ntor handshake against the
+// peer identified by Config.ObfsCert, and returns a net.Conn that speaks
+// clear shadowsocks bytes to callers.
+func DialObfs4(target string, c *Config) (conn net.Conn, err error) {
+	defer func() {
+		if err != nil && conn != nil {
+			conn.Close()
+		}
+	}()
+	conn, err = net.Dial("tcp", c.effectiveDialAddr(target))
+	if err != nil {
+		return
+	}
+	nodeID, serverPub, err := parseObfs4Cert(c.ObfsCert)
+	if err != nil {
+		return
+	}
+	keys, err := ntorClientHandshake(conn, nodeID, serverPub)
+	if err != nil {
+		return
+	}
+	conn = NewObfs4Conn(conn, keys, true, c.Obfs4IatMode)
+	return
+}
+
+func obfs4AcceptHandler(conn net.Conn, lis *listener) (c net.Conn) {
+	defer func() {
+		if conn != nil && c == nil {
+			conn.Close()
+		}
+	}()
+	if lis.c.obfs4ID == nil {
+		return
+	}
+	keys, err := ntorServerHandshake(conn, lis.c.obfs4ID)
+	if err != nil {
+		return
+	}
+	c = NewObfs4Conn(conn, keys, false, lis.c.Obfs4IatMode)
+	return
+}
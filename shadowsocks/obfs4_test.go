@@ -0,0 +1,81 @@
+package shadowsocks
+
+import (
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+func TestElligator2RoundTrip(t *testing.T) {
+	const trials = 4000
+	encoded := 0
+	for i := 0; i < trials; i++ {
+		var priv, pub [obfs4KeyLen]byte
+		if _, err := rand.Read(priv[:]); err != nil {
+			t.Fatal(err)
+		}
+		priv[0] &= 248
+		priv[31] &= 127
+		priv[31] |= 64
+		curve25519.ScalarBaseMult(&pub, &priv)
+
+		rep, ok := elligator2Encode(&pub)
+		if !ok {
+			continue
+		}
+		encoded++
+		got := elligator2Decode(&rep)
+		if got != pub {
+			t.Fatalf("round trip mismatch: encode/decode(%x) = %x, want %x", pub, got, pub)
+		}
+	}
+	if encoded == 0 {
+		t.Fatal("elligator2Encode never succeeded across trials")
+	}
+}
+
+// TestObfs4IatModeNonBlocking checks that enabling Obfs4IatMode perturbs
+// frame timing off a background goroutine instead of blocking Write, and
+// that frames still arrive intact.
+func TestObfs4IatModeNonBlocking(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	keys := &obfs4SessionKeys{}
+	cc := NewObfs4Conn(client, keys, true, true)
+	defer cc.Close()
+	sc := NewObfs4Conn(server, keys, false, false)
+	defer sc.Close()
+
+	const frames = 5
+	done := make(chan struct{})
+	go func() {
+		buf := make([]byte, 5)
+		for i := 0; i < frames; i++ {
+			if _, err := sc.Read(buf); err != nil {
+				return
+			}
+		}
+		close(done)
+	}()
+
+	start := time.Now()
+	for i := 0; i < frames; i++ {
+		if _, err := cc.Write([]byte("hello")); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Millisecond {
+		t.Fatalf("Write blocked for %v, want near-instant with iatMode", elapsed)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for frames")
+	}
+}
@@ -0,0 +1,46 @@
+package shadowsocks
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+// partialWriteConn writes back at most n bytes, regardless of the length
+// of the slice passed in, optionally returning err once it has done so.
+type partialWriteConn struct {
+	net.Conn
+	n   int
+	err error
+}
+
+func (c *partialWriteConn) Write(b []byte) (int, error) {
+	n := c.n
+	if n > len(b) {
+		n = len(b)
+	}
+	return n, c.err
+}
+
+// TestDelayConnPushWriteContract checks that PushWrite never reports
+// writing more of b than b itself contains, even when it also flushes
+// previously buffered bytes ahead of it in the same underlying write.
+func TestDelayConnPushWriteContract(t *testing.T) {
+	// Buffered prefix "BUFFERED" (8 bytes) + b "hello" (5 bytes) = 13,
+	// but only 10 bytes make it out before the write errors: all 8
+	// buffered bytes plus 2 of b's.
+	c := &DelayConn{
+		Conn: &partialWriteConn{n: 10, err: errors.New("boom")},
+		buf:  []byte("BUFFERED"),
+	}
+	n, err := c.PushWrite([]byte("hello"))
+	if err == nil {
+		t.Fatal("expected error to propagate")
+	}
+	if n != 2 {
+		t.Fatalf("n = %d, want 2 (bytes of b actually written)", n)
+	}
+	if n > len("hello") {
+		t.Fatalf("n = %d exceeds len(b), violates io.Writer contract", n)
+	}
+}
@@ -0,0 +1,200 @@
+package shadowsocks
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// SIP003 lets shadowsocks-go front itself with an external obfuscator
+// (v2ray-plugin, obfs-local, xray-plugin, ...) instead of reimplementing
+// each transport in this module: we spawn the plugin as a subprocess and
+// hand it the well-known SS_* environment variables it expects, and it
+// speaks cleartext shadowsocks to a loopback port on our side.
+const (
+	pluginRestartBackoffMin = time.Second
+	pluginRestartBackoffMax = time.Second * 30
+)
+
+type pluginProcess struct {
+	mu        sync.Mutex
+	cmd       *exec.Cmd
+	name      string
+	opts      string
+	env       []string
+	localAddr string // where we should dial (client) or listen (server)
+	isServer  bool
+	stopping  bool
+}
+
+// freeLoopbackAddr grabs an ephemeral loopback port by binding and
+// immediately releasing it, the same trick net/http/httptest uses.
+func freeLoopbackAddr() (string, error) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+	return addr, nil
+}
+
+// StartPlugin spawns Config.Plugin if set. On a "local" config the
+// plugin listens on a loopback port that DialObfs and friends should
+// target instead of Config.Remoteaddr; on a "server" config the plugin
+// becomes the public listener on Config.Localaddr and forwards to a
+// loopback port that our own listener should bind instead.
+func (c *Config) StartPlugin() error {
+	if len(c.Plugin) == 0 {
+		return nil
+	}
+	isServer := c.Type == "server"
+	var remoteHost, remotePort, localHost, localPort string
+	var err error
+	p := &pluginProcess{name: c.Plugin, opts: c.PluginOpts, isServer: isServer}
+	if isServer {
+		// A SIP003 server-mode plugin is the public listener: it binds
+		// SS_REMOTE (here, our real public Localaddr) and forwards to
+		// SS_LOCAL (the loopback port our own listener binds instead).
+		loopback, err := freeLoopbackAddr()
+		if err != nil {
+			return err
+		}
+		remoteHost, remotePort, err = net.SplitHostPort(c.Localaddr)
+		if err != nil {
+			return err
+		}
+		localHost, localPort, err = net.SplitHostPort(loopback)
+		if err != nil {
+			return err
+		}
+		p.localAddr = loopback
+	} else {
+		loopback, err := freeLoopbackAddr()
+		if err != nil {
+			return err
+		}
+		remoteHost, remotePort, err = net.SplitHostPort(c.Remoteaddr)
+		if err != nil {
+			return err
+		}
+		localHost, localPort, err = net.SplitHostPort(loopback)
+		if err != nil {
+			return err
+		}
+		p.localAddr = loopback
+	}
+	p.env = append(os.Environ(),
+		"SS_REMOTE_HOST="+remoteHost,
+		"SS_REMOTE_PORT="+remotePort,
+		"SS_LOCAL_HOST="+localHost,
+		"SS_LOCAL_PORT="+localPort,
+		"SS_PLUGIN_OPTIONS="+c.PluginOpts,
+	)
+	if err = p.start(); err != nil {
+		return err
+	}
+	c.plugin = p
+	go p.superviseLoop()
+	return nil
+}
+
+// StopPlugin kills the plugin subprocess, if one was started, without
+// triggering the restart-on-crash supervisor.
+func (c *Config) StopPlugin() {
+	if c.plugin == nil {
+		return
+	}
+	c.plugin.stop()
+}
+
+func (p *pluginProcess) start() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopping {
+		return fmt.Errorf("plugin %s: stopped", p.name)
+	}
+	cmd := exec.Command(p.name)
+	cmd.Env = p.env
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("plugin %s: %v", p.name, err)
+	}
+	p.cmd = cmd
+	return nil
+}
+
+func (p *pluginProcess) stop() {
+	p.mu.Lock()
+	p.stopping = true
+	cmd := p.cmd
+	p.mu.Unlock()
+	if cmd != nil && cmd.Process != nil {
+		cmd.Process.Kill()
+	}
+}
+
+// superviseLoop restarts the plugin with exponential backoff if it exits
+// unexpectedly, so a transient plugin crash doesn't take the whole
+// tunnel down for good.
+func (p *pluginProcess) superviseLoop() {
+	backoff := pluginRestartBackoffMin
+	for {
+		p.mu.Lock()
+		cmd := p.cmd
+		p.mu.Unlock()
+		if cmd == nil {
+			return
+		}
+		started := time.Now()
+		cmd.Wait()
+		if time.Since(started) > pluginRestartBackoffMax {
+			// it ran long enough to count as healthy: start over
+			backoff = pluginRestartBackoffMin
+		}
+		p.mu.Lock()
+		stopping := p.stopping
+		p.mu.Unlock()
+		if stopping {
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > pluginRestartBackoffMax {
+			backoff = pluginRestartBackoffMax
+		}
+		p.mu.Lock()
+		stopping = p.stopping
+		p.mu.Unlock()
+		if stopping {
+			return
+		}
+		if err := p.start(); err != nil {
+			continue
+		}
+	}
+}
+
+// effectiveDialAddr is what DialObfs and the other direct dialers should
+// actually connect to: the plugin's loopback port when one is running,
+// otherwise the configured remote.
+func (c *Config) effectiveDialAddr(target string) string {
+	if c.plugin != nil && !c.plugin.isServer {
+		return c.plugin.localAddr
+	}
+	return target
+}
+
+// ListenAddr is what the server-side listener should bind: a loopback
+// port forwarded to by the plugin when one is configured as the public
+// front-end, otherwise Config.Localaddr itself.
+func (c *Config) ListenAddr() string {
+	if c.plugin != nil && c.plugin.isServer {
+		return c.plugin.localAddr
+	}
+	return c.Localaddr
+}